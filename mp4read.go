@@ -2,6 +2,7 @@
 package mp4read
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -19,6 +20,17 @@ type mp4videoRead struct {
 	sampleEnd    int
 	decodingTime int64
 	dataOffset   int64
+	fragSample   int64 // フラグメントモードでの通しサンプル番号
+}
+
+// mp4audioRead NextAudioSampleの読み取り位置。ビデオ側のreadとは独立して進む。
+type mp4audioRead struct {
+	chunkIdx     int
+	sampleIdx    int
+	sampleEnd    int
+	decodingTime int64
+	dataOffset   int64
+	fragSample   int64 // フラグメントモードでの通しサンプル番号
 }
 type Mp4read struct {
 	mp4fh      *os.File
@@ -26,9 +38,68 @@ type Mp4read struct {
 	probe      *mp4.ProbeInfo
 	track      *mp4.Track
 	read       mp4videoRead
+	codec      Codec
+	width      int // HEVCのWidth。AVCではtrack.AVC.Widthを使う
+	height     int // HEVCのHeight。AVCではtrack.AVC.Heightを使う
 	spspps     [][]byte
+	vps        [][]byte // HEVCのVPS。AVCでは常にnil
+	nalLenSize int      // mdat内のNALユニット長さフィールドのサイズ(byte)
 	stss       []uint32 //IDR
 	_starttime int      //１フレーム目のCompositionTimeを0に補正するための値
+
+	// IgnoreEditList
+	//
+	// trueにするとelst(EditList)を無視し、stblのサンプルテーブル通りの生の時刻を使います。
+	IgnoreEditList bool
+	editClipStart  int64 // elst適用後の有効範囲の開始(media timescale)。この前のサンプルはNextSampleで読み飛ばす
+	editClipEnd    int64 // elst適用後の有効範囲の終了(media timescale)。-1なら無制限
+
+	fragmented bool          // moof/trafでサンプルを記述するfragmented mp4かどうか
+	fragments  []mp4Fragment // フラグメントごとのサンプルテーブル
+
+	audioTrack        *mp4.Track
+	audioRead         mp4audioRead
+	audioConfig       []byte // esds DecoderSpecificInfoのAudioSpecificConfig
+	audioSampleRate   int
+	audioChannelCount int
+	audioFragments    []mp4Fragment // フラグメントごとのサンプルテーブル(音声)
+}
+
+// mp4Fragment moof/traf/trunから構築した1フラグメント分のサンプルテーブル
+type mp4Fragment struct {
+	baseDecodeTime int64
+	samples        []fragSample
+}
+
+// fragSample フラグメント内の1サンプル分の情報
+type fragSample struct {
+	offset            int64
+	size              uint32
+	duration          uint32
+	compositionOffset int64
+	sync              bool // sample_is_non_sync_sampleが立っていない(=IDR相当)
+}
+
+// Codec
+//
+// ビデオトラックのコーデック種別
+type Codec int
+
+const (
+	CodecUnknown Codec = iota
+	CodecAVC
+	CodecHEVC
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecAVC:
+		return "avc"
+	case CodecHEVC:
+		return "hevc"
+	default:
+		return "unknown"
+	}
 }
 
 // VideoSampleInfo
@@ -41,6 +112,8 @@ type VideoSampleInfo struct {
 	TimeDelta       uint32 // サンプルの再生時間
 	Number          int64  // サンプルの番号。フレーム番号ではない。
 	CompositionTime int64  // 1サンプル目を0とした時の再生時刻
+	DecodingTime    int64  // CompositionTimeと同じ補正値を引いたデコード時刻(DTS)。1サンプル目でも0になるとは限らない
+	sync            bool   // fragmented mp4でtrunのsample_is_non_sync_sampleが立っていない(=IDR相当)
 }
 
 // VideoInfo
@@ -52,6 +125,28 @@ type VideoInfo struct {
 	Duration  int64 // Duration()
 	Timescale int64 // Timescale()
 	Samples   int   // フレーム数
+	Codec     Codec // CodecAVC / CodecHEVC
+}
+
+// AudioSampleInfo
+//
+// オーディオのサンプル情報。ReadMdatAtAudioSampleに渡すとサンプルデータを取得できる。
+type AudioSampleInfo struct {
+	offset    int64
+	size      uint32
+	TimeDelta uint32 // サンプルの再生時間
+	Number    int64  // サンプルの番号
+}
+
+// AudioInfo
+//
+// オーディオトラックの情報。
+type AudioInfo struct {
+	SampleRate   int
+	ChannelCount int
+	Duration     int64 // Duration()
+	Timescale    int64 // Timescale()
+	Samples      int   // フレーム数
 }
 
 var ErrEndOfStream = fmt.Errorf("end of stream")
@@ -149,21 +244,39 @@ func (v *Mp4read) VideoInfo() (*VideoInfo, error) {
 	if v.track == nil {
 		return nil, errors.New("video not found")
 	}
+	var width, height int
+	if v.codec == CodecHEVC {
+		width, height = v.width, v.height
+	} else {
+		width, height = int(v.track.AVC.Width), int(v.track.AVC.Height)
+	}
+	samples := len(v.track.Samples)
+	for _, frag := range v.fragments {
+		samples += len(frag.samples)
+	}
 	return &VideoInfo{
-		Width:     int(v.track.AVC.Width),
-		Height:    int(v.track.AVC.Height),
+		Width:     width,
+		Height:    height,
 		Duration:  int64(v.track.Duration),
 		Timescale: int64(v.track.Timescale),
-		Samples:   len(v.track.Samples),
+		Samples:   samples,
+		Codec:     v.codec,
 	}, nil
 }
 
+// IsFragmented
+//
+// moof/trafでサンプルを記述するfragmented mp4かどうか
+func (v *Mp4read) IsFragmented() bool {
+	return v.fragmented
+}
+
 // GetVideoTracks
 //
 // mp4に含まれるビデオトラックのリスト
 func (v *Mp4read) GetVideoTracks() (r []int64) {
 	for _, track := range v.probe.Tracks {
-		if track.AVC == nil {
+		if track.AVC == nil && !v.hasHEVCSampleEntry(track.TrackID) {
 			continue
 		}
 		r = append(r, int64(track.TrackID))
@@ -178,8 +291,15 @@ func (v *Mp4read) SetVideoTrack(id int64) error {
 	v.track = nil
 	v.stss = nil
 	v.spspps = nil
+	v.vps = nil
+	v.codec = CodecUnknown
+	v.fragmented = false
+	v.fragments = nil
+	v.editClipStart = 0
+	v.editClipEnd = -1
 	for _, track := range v.probe.Tracks {
-		if track.AVC == nil {
+		isHEVC := track.AVC == nil && v.hasHEVCSampleEntry(track.TrackID)
+		if track.AVC == nil && !isHEVC {
 			continue
 		}
 		if id != -1 && id != int64(track.TrackID) {
@@ -187,11 +307,120 @@ func (v *Mp4read) SetVideoTrack(id int64) error {
 		}
 
 		v.track = track
+		if isHEVC {
+			v.codec = CodecHEVC
+		} else {
+			v.codec = CodecAVC
+		}
 		return nil
 	}
 	return fmt.Errorf("video track not found: #%d", id)
 }
 
+// hasHEVCSampleEntry stsdにhvc1/hev1のSample Entryがあるか調べる
+func (v *Mp4read) hasHEVCSampleEntry(trackid uint32) bool {
+	bips, err := mp4.ExtractBoxesWithPayload(v.r, nil, []mp4.BoxPath{
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeTkhd()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeHvc1()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeHev1()},
+	})
+	if err != nil {
+		return false
+	}
+	target := false
+	found := false
+	for _, bip := range bips {
+		switch bip.Info.Type {
+		case mp4.BoxTypeTkhd():
+			target = bip.Payload.(*mp4.Tkhd).TrackID == trackid
+		case mp4.BoxTypeHvc1(), mp4.BoxTypeHev1():
+			if target {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// GetAudioTracks
+//
+// mp4に含まれるオーディオトラックのリスト
+func (v *Mp4read) GetAudioTracks() (r []int64) {
+	for _, track := range v.probe.Tracks {
+		if !v.hasMp4aSampleEntry(track.TrackID) {
+			continue
+		}
+		r = append(r, int64(track.TrackID))
+	}
+	return
+}
+
+// SetAudioTrack
+//
+// Initialize()の前に取り出す対象のオーディオトラックを指定。-1なら最初のオーディオトラック。
+func (v *Mp4read) SetAudioTrack(id int64) error {
+	v.audioTrack = nil
+	v.audioRead = mp4audioRead{}
+	v.audioConfig = nil
+	v.audioFragments = nil
+	for _, track := range v.probe.Tracks {
+		if !v.hasMp4aSampleEntry(track.TrackID) {
+			continue
+		}
+		if id != -1 && id != int64(track.TrackID) {
+			continue
+		}
+
+		v.audioTrack = track
+		return nil
+	}
+	return fmt.Errorf("audio track not found: #%d", id)
+}
+
+// hasMp4aSampleEntry stsdにmp4aのSample Entryがあるか調べる
+func (v *Mp4read) hasMp4aSampleEntry(trackid uint32) bool {
+	bips, err := mp4.ExtractBoxesWithPayload(v.r, nil, []mp4.BoxPath{
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeTkhd()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeMp4a()},
+	})
+	if err != nil {
+		return false
+	}
+	target := false
+	found := false
+	for _, bip := range bips {
+		switch bip.Info.Type {
+		case mp4.BoxTypeTkhd():
+			target = bip.Payload.(*mp4.Tkhd).TrackID == trackid
+		case mp4.BoxTypeMp4a():
+			if target {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// AudioInfo
+//
+// 選択されているオーディオトラックの情報
+func (v *Mp4read) AudioInfo() (*AudioInfo, error) {
+	if v.audioTrack == nil {
+		return nil, errors.New("audio not found")
+	}
+	samples := len(v.audioTrack.Samples)
+	for _, frag := range v.audioFragments {
+		samples += len(frag.samples)
+	}
+	return &AudioInfo{
+		SampleRate:   v.audioSampleRate,
+		ChannelCount: v.audioChannelCount,
+		Duration:     int64(v.audioTrack.Duration),
+		Timescale:    int64(v.audioTrack.Timescale),
+		Samples:      samples,
+	}, nil
+}
+
 // Initialize
 //
 // video trackの詳細を読み込みます。
@@ -205,6 +434,25 @@ func (v *Mp4read) Initialize() error {
 		return err
 	}
 
+	if v.audioTrack != nil {
+		if err := v.loadAudioTrackInfo(v.audioTrack.TrackID); err != nil {
+			return err
+		}
+	}
+
+	if len(v.probe.Segments) > 0 {
+		// moof/trafでサンプルを記述するfragmented mp4。moovにサンプルが無いinit segmentも許容する。
+		v.fragmented = true
+		if err := v.loadFragments(); err != nil {
+			return err
+		}
+	}
+	if v.fragmented {
+		// 各フラグメントのCompositionTimeOffsetはtfdtのBaseMediaDecodeTimeが基準になっているため、
+		// moovのサンプルテーブルを前提にした1フレーム目の補正は行わない。
+		return nil
+	}
+
 	//bフレームの影響でcttsのCompositionTimeOffsetで1フレーム目の時間が0にならない時の補正
 	starttime := 2147483647
 	decodingTime := 0
@@ -218,22 +466,74 @@ func (v *Mp4read) Initialize() error {
 	if starttime != 2147483647 {
 		v._starttime = starttime
 	}
+
+	v.applyEditList()
 	return nil
 }
 
+// applyEditList track.EditList(elst)を読み取り、_starttimeと有効サンプル範囲に反映する。
+// IgnoreEditListが立っている場合、またはelstが無い場合は何もしない(常にeditClipStart=0,
+// editClipEnd=-1(無制限)にリセットされる)。
+//
+// 空編集(MediaTime==-1)はSegmentDurationの分だけ提示開始を遅らせる補正として_starttimeに反映する。
+// 通常の編集はMediaTimeをメディア時間の原点としてずらし、[MediaTime, MediaTime+SegmentDuration)の
+// 範囲外のサンプルをNextSampleで読み飛ばす対象にする。複数の通常編集が
+// あるseamless loop等のケースは最初の1つだけを扱う。
+// fragmented mp4ではInitializeから呼ばれないため、elstは適用されない。
+func (v *Mp4read) applyEditList() {
+	v.editClipStart = 0
+	v.editClipEnd = -1
+	if v.IgnoreEditList || len(v.track.EditList) == 0 {
+		return
+	}
+
+	movieTimescale := int64(v.probe.Timescale)
+	mediaTimescale := int64(v.track.Timescale)
+
+	var delay int64
+	for _, e := range v.track.EditList {
+		if e.MediaTime == -1 {
+			if movieTimescale > 0 {
+				delay += int64(e.SegmentDuration) * mediaTimescale / movieTimescale
+			}
+			continue
+		}
+		v.editClipStart = int64(e.MediaTime)
+		if movieTimescale > 0 {
+			v.editClipEnd = v.editClipStart + int64(e.SegmentDuration)*mediaTimescale/movieTimescale
+		}
+		break
+	}
+	v._starttime += int(v.editClipStart - delay)
+}
+
 // GetSPSPPS
 //
-// avcC Box内のSPS/PPSデータ
+// avcC/hvcC Box内のSPS/PPSデータ
 func (v *Mp4read) GetSPSPPS() [][]byte {
 	return v.spspps
 }
 
-// loadTrackInfo h264デコードに必要な指定IDのSPSPPS情報などを読み取る
+// GetVPSSPSPPS
+//
+// HEVCのhvcC Box内のVPS/SPS/PPSデータ。AVCの場合はGetSPSPPS()と同じ内容を返します。
+func (v *Mp4read) GetVPSSPSPPS() [][]byte {
+	if len(v.vps) == 0 {
+		return v.spspps
+	}
+	return append(slices.Clone(v.vps), v.spspps...)
+}
+
+// loadTrackInfo デコードに必要な指定IDのVPS/SPS/PPS情報などを読み取る
 func (v *Mp4read) loadTrackInfo(trackid uint32) error {
 	bips, err := mp4.ExtractBoxesWithPayload(v.r, nil, []mp4.BoxPath{
 		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeTkhd()},
 		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStss()},
 		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeAvc1(), mp4.BoxTypeAvcC()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeHvc1()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeHvc1(), mp4.BoxTypeHvcC()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeHev1()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeHev1(), mp4.BoxTypeHvcC()},
 	})
 	if err != nil {
 		return err
@@ -265,10 +565,219 @@ func (v *Mp4read) loadTrackInfo(trackid uint32) error {
 			for _, pps := range avcC.PictureParameterSets {
 				v.spspps = append(v.spspps, pps.NALUnit)
 			}
+			v.nalLenSize = int(avcC.LengthSizeMinusOne) + 1
+
+		case mp4.BoxTypeHvc1():
+			if !target {
+				continue
+			}
+			hvc1 := bip.Payload.(*mp4.VisualSampleEntry)
+			v.width = int(hvc1.Width)
+			v.height = int(hvc1.Height)
+
+		case mp4.BoxTypeHev1():
+			if !target {
+				continue
+			}
+			hev1 := bip.Payload.(*mp4.VisualSampleEntry)
+			v.width = int(hev1.Width)
+			v.height = int(hev1.Height)
+
+		case mp4.BoxTypeHvcC():
+			if !target {
+				continue
+			}
+			// mdatにVPS/SPS/PPSが無い時に必要
+			hvcC := bip.Payload.(*mp4.HvcC)
+			v.vps = make([][]byte, 0, 2)
+			v.spspps = make([][]byte, 0, 4)
+			for _, nalArray := range hvcC.NaluArrays {
+				for _, nalu := range nalArray.Nalus {
+					switch nalArray.NaluType & 0x3f {
+					case 32: // VPS
+						v.vps = append(v.vps, nalu.NALUnit)
+					case 33, 34: // SPS, PPS
+						v.spspps = append(v.spspps, nalu.NALUnit)
+					}
+				}
+			}
+			v.nalLenSize = int(hvcC.LengthSizeMinusOne) + 1
 		}
 	}
 	if v.spspps == nil {
-		return errors.New("avcC not found")
+		return errors.New("avcC/hvcC not found")
+	}
+	return nil
+}
+
+// GetAudioSpecificConfig
+//
+// esds Box内のAudioSpecificConfigデータ
+func (v *Mp4read) GetAudioSpecificConfig() []byte {
+	return v.audioConfig
+}
+
+// loadAudioTrackInfo AACデコードに必要な指定IDのAudioSpecificConfigなどを読み取る
+func (v *Mp4read) loadAudioTrackInfo(trackid uint32) error {
+	bips, err := mp4.ExtractBoxesWithPayload(v.r, nil, []mp4.BoxPath{
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeTkhd()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeMp4a()},
+		{mp4.BoxTypeMoov(), mp4.BoxTypeTrak(), mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeMp4a(), mp4.BoxTypeEsds()},
+	})
+	if err != nil {
+		return err
+	}
+	target := false
+	for _, bip := range bips {
+		switch bip.Info.Type {
+		case mp4.BoxTypeTkhd():
+			target = bip.Payload.(*mp4.Tkhd).TrackID == trackid
+
+		case mp4.BoxTypeMp4a():
+			if !target {
+				continue
+			}
+			mp4a := bip.Payload.(*mp4.AudioSampleEntry)
+			v.audioChannelCount = int(mp4a.ChannelCount)
+			v.audioSampleRate = int(mp4a.SampleRate >> 16) // 16.16 fixed point
+
+		case mp4.BoxTypeEsds():
+			if !target {
+				continue
+			}
+			// mdatにAudioSpecificConfigが無い時(ADTS生成)に必要
+			esds := bip.Payload.(*mp4.Esds)
+			v.audioConfig = extractAudioSpecificConfig(esds)
+		}
+	}
+	if v.audioConfig == nil {
+		return errors.New("esds/AudioSpecificConfig not found")
+	}
+	return nil
+}
+
+// extractAudioSpecificConfig esdsのDecoderSpecificInfo(tag 0x05)からAudioSpecificConfigを取り出す
+func extractAudioSpecificConfig(esds *mp4.Esds) []byte {
+	const decSpecificInfoTag = 0x05
+	for _, d := range esds.Descriptors {
+		if d.Tag == decSpecificInfoTag {
+			return slices.Clone(d.Data)
+		}
+	}
+	return nil
+}
+
+// loadFragments moof/traf/trunを走査し、トラックのフラグメントごとのサンプルテーブルを構築する
+func (v *Mp4read) loadFragments() error {
+	bips, err := mp4.ExtractBoxesWithPayload(v.r, nil, []mp4.BoxPath{
+		{mp4.BoxTypeMoof()},
+		{mp4.BoxTypeMoof(), mp4.BoxTypeTraf(), mp4.BoxTypeTfhd()},
+		{mp4.BoxTypeMoof(), mp4.BoxTypeTraf(), mp4.BoxTypeTfdt()},
+		{mp4.BoxTypeMoof(), mp4.BoxTypeTraf(), mp4.BoxTypeTrun()},
+	})
+	if err != nil {
+		return err
+	}
+
+	var moofOffset, baseDataOffset int64
+	var decodeTime int64
+	var defaultSampleDuration, defaultSampleFlags uint32
+	isVideo, isAudio := false, false
+
+	for _, bip := range bips {
+		switch bip.Info.Type {
+		case mp4.BoxTypeMoof():
+			moofOffset = int64(bip.Info.Offset)
+			baseDataOffset = moofOffset
+			defaultSampleDuration = 0
+			defaultSampleFlags = 0
+			decodeTime = 0
+			isVideo = false
+			isAudio = false
+
+		case mp4.BoxTypeTfhd():
+			tfhd := bip.Payload.(*mp4.Tfhd)
+			isVideo = tfhd.TrackID == v.track.TrackID
+			isAudio = v.audioTrack != nil && tfhd.TrackID == v.audioTrack.TrackID
+			if !isVideo && !isAudio {
+				continue
+			}
+			baseDataOffset = moofOffset
+			if tfhd.CheckFlag(mp4.TfhdBaseDataOffsetPresent) {
+				baseDataOffset = int64(tfhd.BaseDataOffset)
+			}
+			if tfhd.CheckFlag(mp4.TfhdDefaultSampleDurationPresent) {
+				defaultSampleDuration = tfhd.DefaultSampleDuration
+			}
+			if tfhd.CheckFlag(mp4.TfhdDefaultSampleFlagsPresent) {
+				defaultSampleFlags = tfhd.DefaultSampleFlags
+			}
+
+		case mp4.BoxTypeTfdt():
+			if !isVideo && !isAudio {
+				continue
+			}
+			tfdt := bip.Payload.(*mp4.Tfdt)
+			decodeTime = int64(tfdt.GetBaseMediaDecodeTime())
+
+		case mp4.BoxTypeTrun():
+			if !isVideo && !isAudio {
+				continue
+			}
+			trun := bip.Payload.(*mp4.Trun)
+			// go-mp4のTrunはTfhdと違いPresentフラグの名前付き定数を公開していないため、
+			// struct定義のopt=タグと同じ値を直接使う。
+			const (
+				trunDataOffsetPresent                  = 0x000001
+				trunFirstSampleFlagsPresent            = 0x000004
+				trunSampleDurationPresent              = 0x000100
+				trunSampleSizePresent                  = 0x000200
+				trunSampleFlagsPresent                 = 0x000400
+				trunSampleCompositionTimeOffsetPresent = 0x000800
+			)
+			offset := baseDataOffset
+			if trun.CheckFlag(trunDataOffsetPresent) {
+				offset += int64(trun.DataOffset)
+			}
+			frag := mp4Fragment{baseDecodeTime: decodeTime, samples: make([]fragSample, 0, len(trun.Entries))}
+			for i, entry := range trun.Entries {
+				duration := defaultSampleDuration
+				if trun.CheckFlag(trunSampleDurationPresent) {
+					duration = entry.SampleDuration
+				}
+				size := uint32(0)
+				if trun.CheckFlag(trunSampleSizePresent) {
+					size = entry.SampleSize
+				}
+				cto := int64(0)
+				if trun.CheckFlag(trunSampleCompositionTimeOffsetPresent) {
+					if trun.GetVersion() == 0 {
+						cto = int64(entry.SampleCompositionTimeOffsetV0)
+					} else {
+						cto = int64(entry.SampleCompositionTimeOffsetV1)
+					}
+				}
+				flags := defaultSampleFlags
+				if i == 0 && trun.CheckFlag(trunFirstSampleFlagsPresent) {
+					flags = trun.FirstSampleFlags
+				} else if trun.CheckFlag(trunSampleFlagsPresent) {
+					flags = entry.SampleFlags
+				}
+				frag.samples = append(frag.samples, fragSample{
+					offset:            offset,
+					size:              size,
+					duration:          duration,
+					compositionOffset: cto,
+					sync:              (flags>>16)&0x1 == 0,
+				})
+				offset += int64(size)
+			}
+			if isVideo {
+				v.fragments = append(v.fragments, frag)
+			} else {
+				v.audioFragments = append(v.audioFragments, frag)
+			}
+		}
 	}
 	return nil
 }
@@ -280,7 +789,14 @@ func (v *Mp4read) NextSample(out *VideoSampleInfo) error {
 	if v.track == nil {
 		return fmt.Errorf("video track not found")
 	}
-	out.NalLengthSize = int(v.track.AVC.LengthSize)
+	if v.codec == CodecHEVC {
+		out.NalLengthSize = v.nalLenSize
+	} else {
+		out.NalLengthSize = int(v.track.AVC.LengthSize)
+	}
+	if v.fragmented {
+		return v.nextFragmentSample(out)
+	}
 	for v.read.chunkIdx < len(v.track.Chunks) {
 		chunk := v.track.Chunks[v.read.chunkIdx]
 		if v.read.sampleEnd == 0 {
@@ -289,26 +805,147 @@ func (v *Mp4read) NextSample(out *VideoSampleInfo) error {
 		}
 		for v.read.sampleIdx < v.read.sampleEnd && v.read.sampleIdx < len(v.track.Samples) {
 			sample := v.track.Samples[v.read.sampleIdx]
+			pts := v.read.decodingTime + sample.CompositionTimeOffset
 
 			out.offset = v.read.dataOffset
 			out.size = sample.Size
-			out.CompositionTime = v.read.decodingTime + sample.CompositionTimeOffset - int64(v._starttime)
+			out.CompositionTime = pts - int64(v._starttime)
+			out.DecodingTime = v.read.decodingTime - int64(v._starttime)
 			out.Number = int64(v.read.sampleIdx)
 			out.TimeDelta = sample.TimeDelta
 
 			v.read.sampleIdx++
 			v.read.dataOffset += int64(sample.Size)
 			v.read.decodingTime += int64(sample.TimeDelta)
-			if sample.Size > 0 {
-				return nil
+			if sample.Size == 0 {
+				continue
 			}
+			if v.outOfEditRange(pts) {
+				// elstでトリムされた範囲外のサンプル
+				continue
+			}
+			return nil
+		}
+		v.read.sampleEnd = 0
+		v.read.chunkIdx++
+	}
+	return ErrEndOfStream
+}
+
+// outOfEditRange ptsがapplyEditListで決まった有効範囲[editClipStart, editClipEnd)の外側かどうか
+func (v *Mp4read) outOfEditRange(pts int64) bool {
+	if pts < v.editClipStart {
+		return true
+	}
+	return v.editClipEnd >= 0 && pts >= v.editClipEnd
+}
+
+// nextFragmentSample fragmented mp4でのNextSample。chunkIdxをフラグメント番号として使う。
+func (v *Mp4read) nextFragmentSample(out *VideoSampleInfo) error {
+	for v.read.chunkIdx < len(v.fragments) {
+		frag := v.fragments[v.read.chunkIdx]
+		if v.read.sampleEnd == 0 {
+			v.read.sampleEnd = len(frag.samples)
+			v.read.decodingTime = frag.baseDecodeTime
 		}
+		for v.read.sampleIdx < v.read.sampleEnd {
+			sample := frag.samples[v.read.sampleIdx]
+			pts := v.read.decodingTime + sample.compositionOffset
+
+			out.offset = sample.offset
+			out.size = sample.size
+			out.CompositionTime = pts - int64(v._starttime)
+			out.DecodingTime = v.read.decodingTime - int64(v._starttime)
+			out.Number = v.read.fragSample
+			out.TimeDelta = sample.duration
+			out.sync = sample.sync
+
+			v.read.sampleIdx++
+			v.read.fragSample++
+			v.read.decodingTime += int64(sample.duration)
+			if sample.size == 0 {
+				continue
+			}
+			if v.outOfEditRange(pts) {
+				continue
+			}
+			return nil
+		}
+		v.read.sampleIdx = 0
 		v.read.sampleEnd = 0
 		v.read.chunkIdx++
 	}
 	return ErrEndOfStream
 }
 
+// NextAudioSample
+//
+// 次のAudioのSampleデータを計算してinfoに代入します。終わりに到達するとErrEndOfStreamを返します。
+// ビデオのNextSampleとは独立した読み取り位置で進みます。
+func (v *Mp4read) NextAudioSample(out *AudioSampleInfo) error {
+	if v.audioTrack == nil {
+		return fmt.Errorf("audio track not found")
+	}
+	if v.fragmented {
+		return v.nextAudioFragmentSample(out)
+	}
+	for v.audioRead.chunkIdx < len(v.audioTrack.Chunks) {
+		chunk := v.audioTrack.Chunks[v.audioRead.chunkIdx]
+		if v.audioRead.sampleEnd == 0 {
+			v.audioRead.sampleEnd = v.audioRead.sampleIdx + int(chunk.SamplesPerChunk)
+			v.audioRead.dataOffset = int64(chunk.DataOffset)
+		}
+		for v.audioRead.sampleIdx < v.audioRead.sampleEnd && v.audioRead.sampleIdx < len(v.audioTrack.Samples) {
+			sample := v.audioTrack.Samples[v.audioRead.sampleIdx]
+
+			out.offset = v.audioRead.dataOffset
+			out.size = sample.Size
+			out.Number = int64(v.audioRead.sampleIdx)
+			out.TimeDelta = sample.TimeDelta
+
+			v.audioRead.sampleIdx++
+			v.audioRead.dataOffset += int64(sample.Size)
+			v.audioRead.decodingTime += int64(sample.TimeDelta)
+			if sample.Size > 0 {
+				return nil
+			}
+		}
+		v.audioRead.sampleEnd = 0
+		v.audioRead.chunkIdx++
+	}
+	return ErrEndOfStream
+}
+
+// nextAudioFragmentSample fragmented mp4でのNextAudioSample。chunkIdxをフラグメント番号として使う。
+func (v *Mp4read) nextAudioFragmentSample(out *AudioSampleInfo) error {
+	for v.audioRead.chunkIdx < len(v.audioFragments) {
+		frag := v.audioFragments[v.audioRead.chunkIdx]
+		if v.audioRead.sampleEnd == 0 {
+			v.audioRead.sampleEnd = len(frag.samples)
+			v.audioRead.decodingTime = frag.baseDecodeTime
+		}
+		for v.audioRead.sampleIdx < v.audioRead.sampleEnd {
+			sample := frag.samples[v.audioRead.sampleIdx]
+
+			out.offset = sample.offset
+			out.size = sample.size
+			out.Number = v.audioRead.fragSample
+			out.TimeDelta = sample.duration
+
+			v.audioRead.sampleIdx++
+			v.audioRead.fragSample++
+			v.audioRead.decodingTime += int64(sample.duration)
+			if sample.size > 0 {
+				return nil
+			}
+		}
+		v.audioRead.sampleIdx = 0
+		v.audioRead.sampleEnd = 0
+		v.audioRead.chunkIdx++
+	}
+	return ErrEndOfStream
+}
+
 // ReadMdatAtSample
 //
 // mdatからSampleデータを読み込みます。
@@ -333,6 +970,197 @@ func (v *Mp4read) ReadMdatAtSample(info *VideoSampleInfo, buf []byte) (avc []byt
 	return
 }
 
+// ReadMdatAtAudioSample
+//
+// mdatからAudioのSampleデータ(ADTSヘッダ無しの生AACフレーム)を読み込みます。
+func (v *Mp4read) ReadMdatAtAudioSample(info *AudioSampleInfo, buf []byte) (aac []byte, err error) {
+	if info.size > uint32(MemoryLimitSampleCapacity) {
+		return buf, fmt.Errorf("sample size capacity over: %d >= MemoryLimitSampleCapacity(%d)", info.size, MemoryLimitSampleCapacity)
+	}
+	if _, err := v.r.Seek(info.offset, io.SeekStart); err != nil {
+		return buf, err
+	}
+	if info.size > uint32(cap(buf)) {
+		aac = make([]byte, info.size)
+	} else {
+		aac = buf[:info.size]
+	}
+	var n int
+	if n, err = io.ReadFull(v.r, aac); err != nil {
+		return
+	} else if n != int(info.size) {
+		err = fmt.Errorf("cant read %d bytes. len()==%d", info.size, n)
+	}
+	return
+}
+
+// ReadMdatAtAudioSampleADTS
+//
+// mdatからAudioのSampleデータを読み込み、AudioSpecificConfigから生成した7byteのADTSヘッダを
+// 先頭に付けて返します。ffmpeg等のAACデコーダ/マルチプレクサにそのまま渡せます。
+func (v *Mp4read) ReadMdatAtAudioSampleADTS(info *AudioSampleInfo, buf []byte) ([]byte, error) {
+	raw, err := v.ReadMdatAtAudioSample(info, buf)
+	if err != nil {
+		return nil, err
+	}
+	header := v.adtsHeader(len(raw))
+	out := make([]byte, 0, len(header)+len(raw))
+	out = append(out, header[:]...)
+	out = append(out, raw...)
+	return out, nil
+}
+
+// adtsHeader AudioSpecificConfigからADTS(Audio Data Transport Stream)ヘッダを作る。CRCは付けない。
+func (v *Mp4read) adtsHeader(frameLen int) [7]byte {
+	var profile, freqIdx, chanCfg byte
+	if len(v.audioConfig) >= 2 {
+		profile = (v.audioConfig[0] >> 3) - 1
+		freqIdx = ((v.audioConfig[0] & 0x07) << 1) | (v.audioConfig[1] >> 7)
+		chanCfg = (v.audioConfig[1] >> 3) & 0x0f
+	} else {
+		chanCfg = byte(v.audioChannelCount)
+	}
+
+	total := frameLen + 7
+	var h [7]byte
+	h[0] = 0xFF
+	h[1] = 0xF1 // MPEG-4, Layer 0, protection absent
+	h[2] = (profile << 6) | (freqIdx << 2) | (chanCfg >> 2)
+	h[3] = (chanCfg&0x03)<<6 | byte(total>>11)
+	h[4] = byte(total >> 3)
+	h[5] = byte(total<<5) | 0x1F
+	h[6] = 0xFC
+	return h
+}
+
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+// isIDRSample サンプルがIDR(Iフレーム)かどうか。fragmented mp4ではstssが無いので
+// trunのsample_flags由来のsync bitを使う。
+func (v *Mp4read) isIDRSample(info *VideoSampleInfo) bool {
+	if v.fragmented {
+		return info.sync
+	}
+	return slices.Contains(v.stss, uint32(info.Number+1))
+}
+
+// ReadMdatAtSampleAnnexB
+//
+// mdatからSampleデータをAnnex-B形式(NAL毎に0x00000001スタートコードを付与)で読み込みます。
+// AVCC形式の長さプレフィックスを置き換えるため、ffmpeg等のNALベースのデコーダやMPEG-TS/RTPへの
+// 変換にそのまま渡せます。IDRサンプルの場合はGetVPSSPSPPS()のパラメータセットを先頭に付加します。
+func (v *Mp4read) ReadMdatAtSampleAnnexB(info *VideoSampleInfo, buf []byte) ([]byte, error) {
+	raw, err := v.ReadMdatAtSample(info, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(raw)+64)
+	if v.isIDRSample(info) {
+		for _, nal := range v.GetVPSSPSPPS() {
+			out = append(out, annexBStartCode...)
+			out = append(out, nal...)
+		}
+	}
+
+	nalLengthSize := info.NalLengthSize
+	for data := raw; len(data) > 0; {
+		if len(data) < nalLengthSize {
+			return nil, fmt.Errorf("broken sample: too short for NAL length(%d)", nalLengthSize)
+		}
+		length := 0
+		for i := 0; i < nalLengthSize; i++ {
+			length = length<<8 | int(data[i])
+		}
+		data = data[nalLengthSize:]
+		if length < 0 || length > len(data) {
+			return nil, fmt.Errorf("broken sample: NAL length %d exceeds remaining %d", length, len(data))
+		}
+		out = append(out, annexBStartCode...)
+		out = append(out, data[:length]...)
+		data = data[length:]
+	}
+	return out, nil
+}
+
+// annexBSampleReader NewAnnexBSampleReaderが返すio.Reader。サンプル全体をメモリに
+// 展開せず、NALを読み進めながらAnnex-Bのバイト列をストリーミングで返す。
+type annexBSampleReader struct {
+	r             io.Reader
+	nalLengthSize int
+	params        [][]byte
+	cur           io.Reader
+	remaining     int64
+	lenbuf        [4]byte
+	done          bool
+}
+
+// NewAnnexBSampleReader
+//
+// infoの指すSampleデータをAnnex-B形式でストリーミング読み出すio.Readerを作ります。
+// ReadMdatAtSampleAnnexBと違いサンプル全体のバッファを確保しません。
+func (v *Mp4read) NewAnnexBSampleReader(info *VideoSampleInfo) (io.Reader, error) {
+	if _, err := v.r.Seek(info.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var params [][]byte
+	if v.isIDRSample(info) {
+		params = v.GetVPSSPSPPS()
+	}
+	return &annexBSampleReader{
+		r:             io.LimitReader(v.r, int64(info.size)),
+		nalLengthSize: info.NalLengthSize,
+		params:        params,
+	}, nil
+}
+
+func (a *annexBSampleReader) Read(p []byte) (int, error) {
+	for {
+		if a.cur != nil {
+			n, err := a.cur.Read(p)
+			if n > 0 {
+				return n, nil
+			}
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			a.cur = nil
+			continue
+		}
+		if len(a.params) > 0 {
+			nal := a.params[0]
+			a.params = a.params[1:]
+			a.cur = io.MultiReader(bytes.NewReader(annexBStartCode), bytes.NewReader(nal))
+			continue
+		}
+		if a.remaining > 0 {
+			n, err := a.r.Read(p[:min(len(p), int(a.remaining))])
+			a.remaining -= int64(n)
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if a.done {
+			return 0, io.EOF
+		}
+		lb := a.lenbuf[:a.nalLengthSize]
+		if _, err := io.ReadFull(a.r, lb); err != nil {
+			if err == io.EOF {
+				a.done = true
+				continue
+			}
+			return 0, err
+		}
+		length := 0
+		for i := 0; i < a.nalLengthSize; i++ {
+			length = length<<8 | int(lb[i])
+		}
+		a.remaining = int64(length)
+		a.cur = bytes.NewReader(annexBStartCode)
+	}
+}
+
 // Seek
 //
 // Timescale()単位の指定時刻より前のIDRに移動
@@ -343,9 +1171,18 @@ func (v *Mp4read) Seek(timestamp int64, force bool) (bool, error) {
 	if v.track == nil {
 		return false, errors.New("track not found")
 	}
+	if v.fragmented {
+		return v.seekFragmented(timestamp, force)
+	}
 	if v.stss == nil {
 		//stssが無ければ作成する。時間がかかる。
-		stss, err := mp4.FindIDRFrames(v.r, v.track)
+		var stss []int
+		var err error
+		if v.codec == CodecHEVC {
+			stss, err = v.findHEVCIDRFrames()
+		} else {
+			stss, err = mp4.FindIDRFrames(v.r, v.track)
+		}
 		if err != nil {
 			return false, err
 		}
@@ -390,3 +1227,94 @@ func (v *Mp4read) Seek(timestamp int64, force bool) (bool, error) {
 	}
 	return false, fmt.Errorf("out of range %d", timestamp)
 }
+
+// seekFragmented fragmented mp4でのSeek。stssが無いのでtrunのsample_flagsから
+// sync sampleを判定してIDR代わりに使う。
+func (v *Mp4read) seekFragmented(timestamp int64, force bool) (bool, error) {
+	timestamp += int64(v._starttime)
+
+	var decodingTime int64
+	var sampleNumber int64
+	var idr mp4videoRead
+	haveIdr := false
+
+	for fragIdx, frag := range v.fragments {
+		decodingTime = frag.baseDecodeTime
+		for sampleIdx, sample := range frag.samples {
+			if sample.size == 0 {
+				continue
+			}
+			if sample.sync {
+				idr.chunkIdx = fragIdx
+				idr.sampleIdx = sampleIdx
+				idr.sampleEnd = len(frag.samples)
+				idr.decodingTime = decodingTime
+				idr.fragSample = sampleNumber
+				haveIdr = true
+			}
+			decodingTime += int64(sample.duration)
+			sampleNumber++
+			if timestamp < decodingTime+sample.compositionOffset {
+				if !haveIdr {
+					return false, fmt.Errorf("idr not found before %d", timestamp)
+				}
+				if !force && idr.fragSample <= v.read.fragSample && v.read.fragSample <= sampleNumber {
+					return false, nil
+				}
+				v.read = idr
+				return true, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("out of range %d", timestamp)
+}
+
+// findHEVCIDRFrames stssが無いHEVCストリームを先頭から走査し、IRAP(NALタイプ16-21)を
+// 含むサンプル番号(0始まり)の一覧を返す。mp4.FindIDRFramesのHEVC版。
+func (v *Mp4read) findHEVCIDRFrames() ([]int, error) {
+	save := v.read
+	v.read = mp4videoRead{}
+	defer func() { v.read = save }()
+
+	var result []int
+	var info VideoSampleInfo
+	var buf []byte
+	for {
+		if err := v.NextSample(&info); err != nil {
+			if err == ErrEndOfStream {
+				break
+			}
+			return nil, err
+		}
+		data, err := v.ReadMdatAtSample(&info, buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = data
+		if isHEVCIRAPSample(data, info.NalLengthSize) {
+			result = append(result, int(info.Number))
+		}
+	}
+	return result, nil
+}
+
+// isHEVCIRAPSample NAL長さプレフィックス形式のサンプルデータにIRAP(NALタイプ16-21)のNALが
+// 含まれるか調べる
+func isHEVCIRAPSample(data []byte, nalLengthSize int) bool {
+	for len(data) > nalLengthSize && nalLengthSize > 0 {
+		length := 0
+		for i := 0; i < nalLengthSize; i++ {
+			length = length<<8 | int(data[i])
+		}
+		data = data[nalLengthSize:]
+		if length <= 0 || length > len(data) {
+			return false
+		}
+		nalType := (data[0] >> 1) & 0x3f
+		if nalType >= 16 && nalType <= 21 {
+			return true
+		}
+		data = data[length:]
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+// Package mpegts provides a minimal MPEG-TS remux writer built on top of mp4read.
+package mpegts
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/y9o/mp4read"
+)
+
+const (
+	tsPacketSize = 188
+
+	patPID   = 0x0000
+	pmtPID   = 0x1000
+	videoPID = 0x0100
+
+	streamTypeAVC  = 0x1B
+	streamTypeHEVC = 0x24
+)
+
+// Write
+//
+// vで選択中のビデオトラックをNextSample/ReadMdatAtSampleAnnexBで読み進めながら、
+// H.264/H.265の単一ビデオPIDを持つMPEG-TSとしてwに書き出します。
+// IDRを含むアクセスユニットの前にPAT/PMTを再送し、そのTSパケットにrandom_access_indicatorと
+// PCRを付けます。PTS/DTSはCompositionTime/DecodingTimeをTimescale()から90kHzへ変換して使います。
+func Write(v *mp4read.Mp4read, w io.Writer) error {
+	info, err := v.VideoInfo()
+	if err != nil {
+		return err
+	}
+	streamType := uint8(streamTypeAVC)
+	if info.Codec == mp4read.CodecHEVC {
+		streamType = streamTypeHEVC
+	}
+	timescale := int64(v.Timescale())
+	if timescale <= 0 {
+		return fmt.Errorf("mpegts: invalid timescale")
+	}
+
+	tw := newTSWriter(w)
+
+	var sample mp4read.VideoSampleInfo
+	var buf []byte
+	for {
+		if err := v.NextSample(&sample); err != nil {
+			if err == mp4read.ErrEndOfStream {
+				break
+			}
+			return err
+		}
+		data, err := v.ReadMdatAtSampleAnnexB(&sample, buf)
+		if err != nil {
+			return err
+		}
+		buf = data
+
+		pts := sample.CompositionTime * 90000 / timescale
+		dts := sample.DecodingTime * 90000 / timescale
+
+		idr := isIDRAnnexB(data, streamType)
+		if idr {
+			if err := tw.writePAT(); err != nil {
+				return err
+			}
+			if err := tw.writePMT(streamType); err != nil {
+				return err
+			}
+		}
+		if err := tw.writeVideoPES(data, pts, dts, idr); err != nil {
+			return err
+		}
+	}
+	return tw.flush()
+}
+
+// isIDRAnnexB Annex-B形式(0x000001/0x00000001スタートコード区切り)のアクセスユニットに
+// IDR/IRAPのNALが含まれるか調べる
+func isIDRAnnexB(data []byte, streamType uint8) bool {
+	for _, nal := range splitAnnexBNALs(data) {
+		if len(nal) == 0 {
+			continue
+		}
+		if streamType == streamTypeHEVC {
+			if t := (nal[0] >> 1) & 0x3f; t >= 16 && t <= 21 {
+				return true
+			}
+		} else if nal[0]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAnnexBNALs Annex-Bのスタートコード(0x000001/0x00000001)でNAL単位に分割する
+func splitAnnexBNALs(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 {
+			continue
+		}
+		if data[i+2] == 1 {
+			if start >= 0 {
+				nals = append(nals, data[start:i])
+			}
+			start = i + 3
+		}
+	}
+	if start >= 0 {
+		nals = append(nals, data[start:])
+	}
+	return nals
+}
@@ -0,0 +1,243 @@
+package mpegts
+
+import (
+	"bufio"
+	"io"
+)
+
+// tsWriter MPEG-TS 188byteパケットの組み立てとPID毎のcontinuity_counterを管理する
+type tsWriter struct {
+	w  *bufio.Writer
+	cc map[uint16]uint8
+}
+
+func newTSWriter(w io.Writer) *tsWriter {
+	return &tsWriter{
+		w:  bufio.NewWriterSize(w, tsPacketSize*32),
+		cc: map[uint16]uint8{},
+	}
+}
+
+func (tw *tsWriter) flush() error {
+	return tw.w.Flush()
+}
+
+// writePAT PID=0x0000にPAT(program_number=1 -> pmtPID)を1パケットで書く
+func (tw *tsWriter) writePAT() error {
+	pmt := uint16(pmtPID)
+	section := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator=1, reserved, section_length=13
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // reserved, version_number=0, current_next_indicator=1
+		0x00,       // section_number
+		0x00,       // last_section_number
+		0x00, 0x01, // program_number=1
+		0xe0 | byte(pmt>>8), byte(pmt), // reserved, program_map_PID
+	}
+	section = appendCRC32(section)
+	return tw.writeSection(patPID, section)
+}
+
+// writePMT PID=0x1000にPMT(単一ビデオストリーム)を1パケットで書く
+func (tw *tsWriter) writePMT(streamType uint8) error {
+	video := uint16(videoPID)
+	section := []byte{
+		0x02,       // table_id
+		0xb0, 0x12, // section_syntax_indicator=1, reserved, section_length=18
+		0x00, 0x01, // program_number=1
+		0xc1,                               // reserved, version_number=0, current_next_indicator=1
+		0x00,                               // section_number
+		0x00,                               // last_section_number
+		0xe0 | byte(video>>8), byte(video), // reserved, PCR_PID = videoPID
+		0xf0, 0x00, // reserved, program_info_length=0
+		streamType,
+		0xe0 | byte(video>>8), byte(video), // reserved, elementary_PID
+		0xf0, 0x00, // reserved, ES_info_length=0
+	}
+	section = appendCRC32(section)
+	return tw.writeSection(pmtPID, section)
+}
+
+// writeSection PAT/PMTのようなPSIセクションをpointer_field付きの1TSパケットにまとめて書く
+func (tw *tsWriter) writeSection(pid uint16, section []byte) error {
+	payload := make([]byte, 0, 1+len(section))
+	payload = append(payload, 0x00) // pointer_field
+	payload = append(payload, section...)
+
+	pkt := make([]byte, tsPacketSize)
+	tw.writeHeader(pkt, pid, true, false, 0)
+	n := copy(pkt[4:], payload)
+	fillStuffing(pkt[4+n:], 0xff)
+	_, err := tw.w.Write(pkt)
+	return err
+}
+
+const maxPayloadNoAF = tsPacketSize - 4 // TSヘッダ4byteに続くadaptation field無しの最大payload
+const pcrFieldSize = 7                  // flagsバイト(1) + PCR(6)。adaptation_field_lengthバイト自体は含まない
+
+// writeVideoPES Annex-BのアクセスユニットをPESでラップし、複数のTSパケットに分割して書く。
+// idrがtrueの先頭パケットにはrandom_access_indicatorとPCRを付ける。
+//
+// PES_packet_lengthは0(不定長)なので、映像ESの終端はadaptation_field_control以外の方法で
+// 示せない。よって最終パケットでpayloadがmaxPayloadNoAFに満たない時は、payload側に
+// パディングを足すのではなく、adaptation field内のstuffing_byteで余りをちょうど埋める。
+func (tw *tsWriter) writeVideoPES(data []byte, pts, dts int64, idr bool) error {
+	pes := buildPESHeader(pts, dts)
+	payload := append(pes, data...)
+
+	first := true
+	for len(payload) > 0 {
+		withPCR := first && idr
+		capacity := maxPayloadNoAF
+		if withPCR {
+			capacity -= 1 + pcrFieldSize
+		}
+
+		n := len(payload)
+		if n > capacity {
+			n = capacity
+		}
+
+		pkt := make([]byte, tsPacketSize)
+		headerLen := tw.writeVideoHeader(pkt, first, withPCR, pts, n)
+		copy(pkt[headerLen:], payload[:n])
+		payload = payload[n:]
+		first = false
+
+		if _, err := tw.w.Write(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeader TSパケット先頭4byte(+必要ならPCR付きadaptation field)を書き、payloadの開始位置を返す
+func (tw *tsWriter) writeHeader(pkt []byte, pid uint16, payloadUnitStart, withPCR bool, pcrBase int64) int {
+	cc := tw.cc[pid]
+	tw.cc[pid] = (cc + 1) & 0x0f
+
+	pkt[0] = 0x47
+	pusi := byte(0)
+	if payloadUnitStart {
+		pusi = 0x40
+	}
+	pkt[1] = pusi | byte(pid>>8)&0x1f
+	pkt[2] = byte(pid)
+
+	if !withPCR {
+		pkt[3] = 0x10 | cc // adaptation_field_control=01(payload only)
+		return 4
+	}
+
+	// adaptation_field_control=11(adaptation field + payload), random_access_indicator + PCR
+	pkt[3] = 0x30 | cc
+	pkt[4] = 7    // adaptation_field_length (random_access_indicator + PCRで固定7byte)
+	pkt[5] = 0x50 // discontinuity=0, random_access_indicator=1, elementary_stream_priority=0, PCR_flag=1
+	writePCR(pkt[6:12], pcrBase)
+	return 12
+}
+
+// writeVideoHeader videoPID用のTSパケット先頭4byte(+必要ならadaptation field)を書き、
+// payloadの開始位置を返す。payloadLenがmaxPayloadNoAFに満たない場合、またはwithPCRの場合は
+// adaptation fieldを付け、PCR(withPCR時)とstuffing_byteでパケットがちょうど188byteになる
+// よう埋める。
+func (tw *tsWriter) writeVideoHeader(pkt []byte, payloadUnitStart, withPCR bool, pcrBase int64, payloadLen int) int {
+	pid := uint16(videoPID)
+	cc := tw.cc[pid]
+	tw.cc[pid] = (cc + 1) & 0x0f
+
+	pkt[0] = 0x47
+	pusi := byte(0)
+	if payloadUnitStart {
+		pusi = 0x40
+	}
+	pkt[1] = pusi | byte(pid>>8)&0x1f
+	pkt[2] = byte(pid)
+
+	if !withPCR && payloadLen == maxPayloadNoAF {
+		pkt[3] = 0x10 | cc // adaptation_field_control=01(payload only)
+		return 4
+	}
+
+	// adaptation_field_control=11(adaptation field + payload)
+	pkt[3] = 0x30 | cc
+	afLen := maxPayloadNoAF - 1 - payloadLen // adaptation_field_length直後に続くbyte数
+	pkt[4] = byte(afLen)
+	pos := 5
+	if afLen > 0 {
+		flags := byte(0)
+		if withPCR {
+			flags = 0x50 // discontinuity=0, random_access_indicator=1, elementary_stream_priority=0, PCR_flag=1
+		}
+		pkt[5] = flags
+		pos = 6
+		if withPCR {
+			writePCR(pkt[6:12], pcrBase)
+			pos = 12
+		}
+		for ; pos < 5+afLen; pos++ {
+			pkt[pos] = 0xff // stuffing_byte
+		}
+	}
+	return 5 + afLen
+}
+
+// writePCR 90kHzのptsベースをそのままprogram_clock_reference_base(33bit)として書く。extensionは0。
+func writePCR(b []byte, pcr90k int64) {
+	base := uint64(pcr90k) & 0x1ffffffff
+	b[0] = byte(base >> 25)
+	b[1] = byte(base >> 17)
+	b[2] = byte(base >> 9)
+	b[3] = byte(base >> 1)
+	b[4] = byte(base<<7) | 0x7e // reserved bits=1, extension高位1bit=0
+	b[5] = 0x00                 // program_clock_reference_extension下位8bit=0
+}
+
+// buildPESHeader PTS/DTS付きのPESパケットヘッダを組み立てる。PES_packet_lengthは映像なので0(不定長)。
+func buildPESHeader(pts, dts int64) []byte {
+	h := []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00} // start code + stream_id(video) + PES_packet_length=0
+	h = append(h, 0x80, 0xc0, 10)                   // flags: marker bits '10', PTS_DTS_flags=11, PES_header_data_length=10
+	h = appendTimestamp(h, 0x3, pts)
+	h = appendTimestamp(h, 0x1, dts)
+	return h
+}
+
+// appendTimestamp PTS/DTSを5byteのPESタイムスタンプ形式で付加する
+func appendTimestamp(h []byte, prefix byte, ts int64) []byte {
+	t := uint64(ts) & 0x1ffffffff
+	b0 := (prefix << 4) | byte((t>>29)&0x0e) | 0x01
+	b1 := byte(t >> 22)
+	b2 := byte((t>>14)&0xfe) | 0x01
+	b3 := byte(t >> 7)
+	b4 := byte((t<<1)&0xfe) | 0x01
+	return append(h, b0, b1, b2, b3, b4)
+}
+
+func fillStuffing(b []byte, v byte) {
+	for i := range b {
+		b[i] = v
+	}
+}
+
+// crc32Mpeg2 PAT/PMTのCRC_32に使うMPEG-2準拠(非反転, 初期値0xffffffff)のCRC32
+func crc32Mpeg2(data []byte) uint32 {
+	const poly = 0x04c11db7
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func appendCRC32(section []byte) []byte {
+	crc := crc32Mpeg2(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}